@@ -0,0 +1,90 @@
+package seal_migration
+
+import (
+	"os"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-kms-wrapping/wrappers/aead"
+	"github.com/hashicorp/go-kms-wrapping/wrappers/awskms"
+	"github.com/hashicorp/vault/helper/testhelpers/sealhelper"
+	"github.com/hashicorp/vault/vault"
+	"github.com/hashicorp/vault/vault/seal"
+)
+
+// newTestTransitSeal builds an auto-unseal backed by a real Transit engine,
+// mounted on an in-process Vault server started just for this seal (see
+// sealhelper.TransitSealServer). Unlike talking to an externally-reachable
+// Transit server, this needs nothing from the environment, so the tests
+// that use it run unattended in ordinary CI.
+func newTestTransitSeal(t *testing.T, logger hclog.Logger) vault.Seal {
+	server := sealhelper.NewTransitSealServer(t)
+	server.MakeKey(t, "seal-migration-test")
+	return server.MakeSeal(t, "seal-migration-test")
+}
+
+// newTestAwsKmsSeal builds an auto-unseal backed by a real AWS KMS key. It is
+// only used by the tests that are gated behind AWS credentials.
+func newTestAwsKmsSeal(t *testing.T, logger hclog.Logger) vault.Seal {
+	wrapper := awskms.NewWrapper(nil)
+	_, err := wrapper.SetConfig(map[string]string{
+		"region":     envOrDefault("AWS_DEFAULT_REGION", "us-east-1"),
+		"kms_key_id": os.Getenv("VAULT_AWSKMS_SEAL_KEY_ID"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return vault.NewAutoSeal(&seal.Access{
+		Wrapper: wrapper,
+	})
+}
+
+// newTestFakeSeal builds an in-process auto-unseal using an AEAD wrapper with
+// a randomly generated key. It behaves like a "real" auto-unseal as far as
+// Vault's seal-migration code path is concerned, but needs no external
+// service, so it is the seal used by the tests that run in normal CI.
+func newTestFakeSeal(t *testing.T, logger hclog.Logger) vault.Seal {
+	wrapper := aead.NewWrapper(nil)
+	_, err := wrapper.SetConfig(map[string]string{
+		"key_id": "seal-migration-fake-key",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wrapper.GenerateKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	return vault.NewAutoSeal(&seal.Access{
+		Wrapper: wrapper,
+	})
+}
+
+// skipUnlessAwsKmsEnv skips the calling test unless the environment is set up
+// to exercise the real AWS KMS seal, since it requires live cloud
+// credentials that are not available in ordinary CI runs.
+func skipUnlessAwsKmsEnv(t *testing.T) {
+	if os.Getenv("VAULT_AWSKMS_SEAL_KEY_ID") == "" {
+		t.Skip("set VAULT_AWSKMS_SEAL_KEY_ID (and standard AWS credential env vars) to run AWS KMS seal migration tests")
+	}
+}
+
+func envOrDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// skipUnlessEnv skips the calling test unless key is set in the environment,
+// returning its value otherwise. It is used to gate the SQL and S3 backend
+// factories, which need live credentials/DSNs that aren't present in
+// ordinary CI runs.
+func skipUnlessEnv(t *testing.T, key string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		t.Skipf("set %s to run this backend's seal migration tests", key)
+	}
+	return v
+}
@@ -0,0 +1,188 @@
+package seal_migration
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/helper/testhelpers"
+	"github.com/hashicorp/vault/helper/testhelpers/teststorage"
+	vaulthttp "github.com/hashicorp/vault/http"
+	"github.com/hashicorp/vault/sdk/helper/logging"
+	"github.com/hashicorp/vault/vault"
+)
+
+const (
+	autopilotPollInterval = 2 * time.Second
+	autopilotPollTimeout  = time.Minute
+)
+
+// waitForAutopilotHealthy polls sys/storage/raft/autopilot/state until every
+// voter is reported healthy and the cluster has at least one voter worth of
+// failure tolerance, or fails the test if that never happens within
+// autopilotPollTimeout. It replaces the fixed sleep that used to precede
+// VerifyRaftConfiguration in reuseShamir.
+func waitForAutopilotHealthy(t *testing.T, client *api.Client) {
+	t.Helper()
+
+	deadline := time.Now().Add(autopilotPollTimeout)
+	for {
+		state, err := client.Sys().RaftAutopilotState()
+		if err == nil && autopilotStateIsHealthy(state) {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("autopilot never reported a healthy cluster: state=%+v, err=%v", state, err)
+		}
+		time.Sleep(autopilotPollInterval)
+	}
+}
+
+// assertAutopilotHealthy is like waitForAutopilotHealthy but fails
+// immediately instead of retrying; it is used mid-migration where a
+// transient unhealthy reading is itself the bug being guarded against.
+func assertAutopilotHealthy(t *testing.T, client *api.Client) {
+	t.Helper()
+
+	state, err := client.Sys().RaftAutopilotState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !autopilotStateIsHealthy(state) {
+		t.Fatalf("autopilot reported an unhealthy cluster during seal migration: %+v", state)
+	}
+}
+
+func autopilotStateIsHealthy(state *api.AutopilotState) bool {
+	if state == nil || !state.Healthy || state.FailureTolerance < 1 {
+		return false
+	}
+	for _, server := range state.Servers {
+		if server.NodeType == "voter" && !server.Healthy {
+			return false
+		}
+	}
+	return true
+}
+
+func waitForAutopilotVoter(t *testing.T, client *api.Client, nodeID string) {
+	t.Helper()
+
+	deadline := time.Now().Add(autopilotPollTimeout)
+	for {
+		state, err := client.Sys().RaftAutopilotState()
+		if err == nil {
+			if server, ok := state.Servers[nodeID]; ok && server.NodeType == "voter" && server.Healthy {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("autopilot never promoted %s to a healthy voter: err=%v", nodeID, err)
+		}
+		time.Sleep(autopilotPollInterval)
+	}
+}
+
+// TestRaftSealMigration_AutopilotPromotion drives seal migration on raft
+// alongside an autopilot-managed voter promotion: the original three cores
+// migrate from Shamir to Transit together, a brand new fourth core is then
+// brought up already configured with the new seal and joins as a non-voter,
+// and autopilot is expected to promote it to voter once it catches up. One
+// of the original, now-migrated voters is then decommissioned. Autopilot
+// must never report the cluster unhealthy during any of this.
+func TestRaftSealMigration_AutopilotPromotion(t *testing.T) {
+	logger := logging.NewVaultLogger(hclog.Debug).Named(t.Name())
+
+	storage, cleanup := teststorage.MakeReusableRaftStorage(t, logger)
+	defer cleanup()
+
+	basePort := 55000
+	baseClusterPort := basePort + 10
+
+	rootToken, keys := initializeShamir(t, logger, storage, basePort)
+	newSeal := newTestTransitSeal(t, logger)
+
+	var conf = vault.CoreConfig{
+		Logger: logger.Named("autopilotPromotion"),
+		Seal:   newSeal,
+	}
+	var opts = vault.TestClusterOptions{
+		HandlerFunc:           vaulthttp.Handler,
+		BaseListenAddress:     fmt.Sprintf("127.0.0.1:%d", basePort),
+		BaseClusterListenPort: baseClusterPort,
+		SkipInit:              true,
+		// One more core than initializeShamir created, so that core 3 is a
+		// genuinely new node rather than one of the original standbys.
+		NumCores: vault.DefaultNumCores + 1,
+		UnwrapSealFunc: func() vault.Seal {
+			return vault.NewDefaultSeal()
+		},
+	}
+	storage.Setup(&conf, &opts)
+	cluster := vault.NewTestCluster(t, &conf, &opts)
+	cluster.Start()
+	defer func() {
+		storage.Cleanup(t, cluster)
+		cluster.Cleanup()
+	}()
+
+	leader := cluster.Cores[0]
+	client := leader.Client
+	client.SetToken(rootToken)
+
+	cluster.BarrierKeys = keys
+	provider := testhelpers.NewHardcodedServerAddressProvider(baseClusterPort)
+	testhelpers.SetRaftAddressProviders(t, cluster, provider)
+
+	// Unseal the three original cores with the old Shamir keys; this is
+	// what triggers migration to newSeal for each of them.
+	for _, core := range cluster.Cores[:vault.DefaultNumCores] {
+		cluster.UnsealCore(t, core)
+	}
+	testhelpers.WaitForNCoresUnsealed(t, cluster, vault.DefaultNumCores)
+	waitForAutopilotHealthy(t, client)
+
+	secret, err := client.Logical().Read("secret/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(secret.Data, map[string]interface{}{"zork": "quux"}); len(diff) > 0 {
+		t.Fatal(diff)
+	}
+
+	// Bring up the fourth core, which has never held Shamir key shares,
+	// and join it to the raft cluster as a non-voter speaking only the new
+	// seal. Autopilot is expected to promote it to voter once it catches
+	// up on the raft log.
+	newCore := cluster.Cores[vault.DefaultNumCores]
+	if _, err := newCore.Client.Sys().RaftJoin(&api.RaftJoinRequest{
+		LeaderAPIAddr: leader.Client.Address(),
+		Retry:         true,
+		NonVoter:      true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	testhelpers.WaitForNCoresUnsealed(t, cluster, vault.DefaultNumCores+1)
+	assertAutopilotHealthy(t, client)
+
+	newVoterID := newCore.NodeID
+	waitForAutopilotVoter(t, client, newVoterID)
+	assertAutopilotHealthy(t, client)
+
+	// Decommission one of the original voters, which migrated to the new
+	// seal in the restart above.
+	oldVoterID := cluster.Cores[1].NodeID
+	if _, err := client.Logical().Write("sys/storage/raft/remove-peer", map[string]interface{}{
+		"server_id": oldVoterID,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	assertAutopilotHealthy(t, client)
+
+	cluster.EnsureCoresSealed(t)
+}
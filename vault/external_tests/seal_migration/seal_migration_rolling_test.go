@@ -0,0 +1,190 @@
+package seal_migration
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/helper/testhelpers"
+	"github.com/hashicorp/vault/helper/testhelpers/teststorage"
+	vaulthttp "github.com/hashicorp/vault/http"
+	"github.com/hashicorp/vault/vault"
+)
+
+// TestShamirToFakeAutoSeal_Rolling exercises a rolling (one node at a time)
+// seal migration from Shamir to an auto-unseal, asserting that the cluster
+// never loses quorum and that the previously written secret stays readable
+// through the whole process, unlike TestShamirToFakeAutoSeal which restarts
+// every core at once. It uses the in-process fake auto-unseal so it runs
+// unattended in ordinary CI.
+func TestShamirToFakeAutoSeal_Rolling(t *testing.T) {
+	testVariousBackends(t, testShamirToFakeAutoSealRolling)
+}
+
+func testShamirToFakeAutoSealRolling(
+	t *testing.T, logger hclog.Logger,
+	storage teststorage.ReusableStorage, basePort int, supportsHA bool) {
+
+	if !supportsHA {
+		t.Skip("rolling seal migration needs a backend with a real HA layer to exercise leader/standby behavior")
+	}
+
+	rootToken, keys := initializeShamir(t, logger, storage, basePort)
+	migrateSealRolling(t, logger, storage, basePort, rootToken, keys, vault.NewDefaultSeal(), newTestFakeSeal(t, logger))
+}
+
+// TestShamirToTransit_Rolling is the same rolling migration exercised
+// against a real Transit seal, backed by the in-process server that
+// newTestTransitSeal stands up.
+func TestShamirToTransit_Rolling(t *testing.T) {
+	testVariousBackends(t, testShamirToTransitRolling)
+}
+
+func testShamirToTransitRolling(
+	t *testing.T, logger hclog.Logger,
+	storage teststorage.ReusableStorage, basePort int, supportsHA bool) {
+
+	if !supportsHA {
+		t.Skip("rolling seal migration needs a backend with a real HA layer to exercise leader/standby behavior")
+	}
+
+	rootToken, keys := initializeShamir(t, logger, storage, basePort)
+	migrateSealRolling(t, logger, storage, basePort, rootToken, keys, vault.NewDefaultSeal(), newTestTransitSeal(t, logger))
+}
+
+// migrateSealRolling brings the cluster back up on oldSeal, then migrates to
+// newSeal one core at a time: it stops a core, restarts it with oldSeal
+// disabled and newSeal active, waits for the core to rejoin the cluster and
+// unseal via newSeal, and only then moves on to the next core. Throughout
+// the whole process it asserts that the leader never loses quorum and that
+// secret/foo stays readable against leader.Client.
+func migrateSealRolling(
+	t *testing.T, logger hclog.Logger,
+	storage teststorage.ReusableStorage, basePort int,
+	rootToken string, keys [][]byte, oldSeal, newSeal vault.Seal) {
+
+	var baseClusterPort = basePort + 10
+
+	var conf = vault.CoreConfig{
+		Logger: logger.Named("migrateSealRolling"),
+		Seal:   oldSeal,
+	}
+	var opts = vault.TestClusterOptions{
+		HandlerFunc:           vaulthttp.Handler,
+		BaseListenAddress:     fmt.Sprintf("127.0.0.1:%d", basePort),
+		BaseClusterListenPort: baseClusterPort,
+		SkipInit:              true,
+	}
+	storage.Setup(&conf, &opts)
+	cluster := vault.NewTestCluster(t, &conf, &opts)
+	cluster.Start()
+	defer func() {
+		storage.Cleanup(t, cluster)
+		cluster.Cleanup()
+	}()
+
+	cluster.BarrierKeys = keys
+	var provider *testhelpers.HardcodedServerAddressProvider
+	if storage.IsRaft {
+		provider = testhelpers.NewHardcodedServerAddressProvider(baseClusterPort)
+		testhelpers.SetRaftAddressProviders(t, cluster, provider)
+	}
+
+	testhelpers.UnsealCoresWithShamirKeys(t, cluster, keys)
+	testhelpers.WaitForNCoresUnsealed(t, cluster, vault.DefaultNumCores)
+	assertQuorumAndSecret(t, awaitRollingLeader(t, cluster, rootToken))
+
+	// Roll the standbys first, and the original leader (core 0) last, so
+	// the cluster always has an old-seal leader to forward requests to
+	// until the very end of the migration. The active leader can still
+	// shift between any two of these steps, so the leader is re-resolved
+	// after every stop/start rather than assumed to still be core 0.
+	rollOrder := []int{1, 2, 0}
+
+	for _, idx := range rollOrder {
+		core := cluster.Cores[idx]
+
+		cluster.StopCore(t, idx)
+		assertQuorumAndSecret(t, awaitRollingLeader(t, cluster, rootToken))
+
+		core.CoreConfig.Seal = newSeal
+		core.CoreConfig.UnwrapSeal = oldSeal
+
+		cluster.StartCore(t, idx, &opts)
+
+		if storage.IsRaft {
+			testhelpers.SetRaftAddressProviders(t, cluster, provider)
+		}
+		// Every core in the cluster must be unsealed again before moving on
+		// to the next one, not just the ones rolled so far: with rollOrder
+		// {1, 2, 0}, idx+1 equals the full core count only on the second
+		// iteration, and undercounts on the first and the last.
+		testhelpers.WaitForNCoresUnsealed(t, cluster, vault.DefaultNumCores)
+		assertQuorumAndSecret(t, awaitRollingLeader(t, cluster, rootToken))
+	}
+
+	leader := awaitRollingLeader(t, cluster, rootToken)
+	if storage.IsRaft {
+		if err := testhelpers.VerifyRaftConfiguration(t, leader.core); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cluster.EnsureCoresSealed(t)
+}
+
+// rollingLeader bundles the active core found by awaitRollingLeader with an
+// *api.Client already pointed at and authenticated against it.
+type rollingLeader struct {
+	core   *vault.TestClusterCore
+	client *api.Client
+}
+
+// awaitRollingLeader polls the cluster's cores until it finds one that is
+// both unsealed and reports itself as the active node, and returns it along
+// with a client authenticated against it. A rolling migration can leave the
+// previous leader sealed mid-loop, so callers must re-resolve the leader
+// after every StopCore/StartCore pair instead of holding on to a stale
+// reference from before the restart.
+func awaitRollingLeader(t *testing.T, cluster *vault.TestCluster, rootToken string) rollingLeader {
+	t.Helper()
+
+	deadline := time.Now().Add(autopilotPollTimeout)
+	for {
+		for _, core := range cluster.Cores {
+			if core.Core.Sealed() {
+				continue
+			}
+			isLeader, _, _, err := core.Core.Leader()
+			if err != nil || !isLeader {
+				continue
+			}
+			client := core.Client
+			client.SetToken(rootToken)
+			return rollingLeader{core: core, client: client}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no core became the active leader during rolling migration")
+		}
+		time.Sleep(autopilotPollInterval)
+	}
+}
+
+// assertQuorumAndSecret asserts that the cluster still has an active leader
+// and that secret/foo remains readable through it, which is the invariant
+// that must hold throughout a rolling migration.
+func assertQuorumAndSecret(t *testing.T, leader rollingLeader) {
+	t.Helper()
+
+	secret, err := leader.client.Logical().Read("secret/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(secret.Data, map[string]interface{}{"zork": "quux"}); len(diff) > 0 {
+		t.Fatal(diff)
+	}
+}
@@ -3,7 +3,6 @@ package seal_migration
 import (
 	"fmt"
 	"testing"
-	"time"
 
 	"github.com/go-test/deep"
 
@@ -19,60 +18,516 @@ func TestShamir(t *testing.T) {
 	testVariousBackends(t, testShamir)
 }
 
-func testVariousBackends(t *testing.T, tf testFunc) {
+// TestShamirToFakeAutoSeal and TestFakeAutoSealToShamir are the always-on
+// CI coverage for the Shamir <-> auto-unseal migration path: they use an
+// in-process fake auto-unseal (see newTestFakeSeal) so they need neither a
+// live Transit server nor cloud credentials.
+func TestShamirToFakeAutoSeal(t *testing.T) {
+	testVariousBackends(t, testShamirToFakeAutoSeal)
+}
 
-	logger := logging.NewVaultLogger(hclog.Debug).Named(t.Name())
+func TestFakeAutoSealToShamir(t *testing.T) {
+	testVariousBackends(t, testFakeAutoSealToShamir)
+}
+
+// TestShamirToTransit and TestTransitToShamir exercise the same migration
+// path against a real Transit seal, backed by the in-process server that
+// newTestTransitSeal stands up, so they also run unattended in ordinary CI.
+func TestShamirToTransit(t *testing.T) {
+	testVariousBackends(t, testShamirToTransit)
+}
+
+func TestTransitToShamir(t *testing.T) {
+	testVariousBackends(t, testTransitToShamir)
+}
+
+// TestTransitToAwsKms and TestAwsKmsToTransit additionally need a real AWS
+// KMS key, so they only run when the environment is set up for it.
+func TestTransitToAwsKms(t *testing.T) {
+	skipUnlessAwsKmsEnv(t)
+	testVariousBackends(t, testTransitToAwsKms)
+}
 
-	t.Run("inmem", func(t *testing.T) {
-		t.Parallel()
+func TestAwsKmsToTransit(t *testing.T) {
+	skipUnlessAwsKmsEnv(t)
+	testVariousBackends(t, testAwsKmsToTransit)
+}
 
-		logger := logger.Named("inmem")
-		storage, cleanup := teststorage.MakeReusableStorage(
-			t, logger, teststorage.MakeInmemBackend(t, logger))
-		defer cleanup()
-		tf(t, logger, storage, 51000)
-	})
+// backendFactory describes one storage configuration that the seal
+// migration tests in this package should run against. NewStorage is
+// responsible for skipping the subtest (via t.Skip) when the backend needs
+// credentials or a DSN that isn't present in the environment.
+type backendFactory struct {
+	Name       string
+	NewStorage func(t *testing.T, logger hclog.Logger) (teststorage.ReusableStorage, func())
+	SupportsHA bool
+}
 
-	t.Run("file", func(t *testing.T) {
-		t.Parallel()
+// variousBackends is the set of storage configurations exercised by
+// testVariousBackends. Adding an entry here makes every seal-migration test
+// in the package that goes through testVariousBackends run against it;
+// TestRaftSealMigration_AutopilotPromotion uses raft storage directly.
+var variousBackends = []backendFactory{
+	{
+		Name: "inmem",
+		NewStorage: func(t *testing.T, logger hclog.Logger) (teststorage.ReusableStorage, func()) {
+			return teststorage.MakeReusableStorage(t, logger, teststorage.MakeInmemBackend(t, logger))
+		},
+	},
+	{
+		Name: "file",
+		NewStorage: func(t *testing.T, logger hclog.Logger) (teststorage.ReusableStorage, func()) {
+			return teststorage.MakeReusableStorage(t, logger, teststorage.MakeFileBackend(t, logger))
+		},
+	},
+	{
+		Name: "consul",
+		NewStorage: func(t *testing.T, logger hclog.Logger) (teststorage.ReusableStorage, func()) {
+			return teststorage.MakeReusableStorage(t, logger, teststorage.MakeConsulBackend(t, logger))
+		},
+		SupportsHA: true,
+	},
+	{
+		Name: "raft",
+		NewStorage: func(t *testing.T, logger hclog.Logger) (teststorage.ReusableStorage, func()) {
+			return teststorage.MakeReusableRaftStorage(t, logger)
+		},
+		SupportsHA: true,
+	},
+	{
+		Name: "postgresql",
+		NewStorage: func(t *testing.T, logger hclog.Logger) (teststorage.ReusableStorage, func()) {
+			dsn := skipUnlessEnv(t, "VAULT_TEST_POSTGRES_DSN")
+			return teststorage.MakeReusableStorage(t, logger, teststorage.MakePostgreSQLBackend(t, logger, dsn))
+		},
+	},
+	{
+		Name: "mysql",
+		NewStorage: func(t *testing.T, logger hclog.Logger) (teststorage.ReusableStorage, func()) {
+			dsn := skipUnlessEnv(t, "VAULT_TEST_MYSQL_DSN")
+			return teststorage.MakeReusableStorage(t, logger, teststorage.MakeMySQLBackend(t, logger, dsn))
+		},
+	},
+	{
+		Name: "s3",
+		NewStorage: func(t *testing.T, logger hclog.Logger) (teststorage.ReusableStorage, func()) {
+			skipUnlessEnv(t, "AWS_ACCESS_KEY_ID")
+			bucket := skipUnlessEnv(t, "VAULT_TEST_S3_BUCKET")
+			return teststorage.MakeReusableStorage(t, logger, teststorage.MakeS3Backend(t, logger, bucket))
+		},
+	},
+	{
+		// Seal migration bugs have historically shown up specifically when
+		// the HA backend differs from the storage backend, so exercise
+		// Consul storage with raft used only for HA/autopilot.
+		Name: "consul-storage+raft-ha",
+		NewStorage: func(t *testing.T, logger hclog.Logger) (teststorage.ReusableStorage, func()) {
+			storage, cleanup := teststorage.MakeReusableRaftHAStorage(t, logger, vault.DefaultNumCores, teststorage.MakeConsulBackend(t, logger))
+			// The storage backend itself is Consul, but raft is still doing
+			// HA/autopilot duty here, so the raft-specific
+			// join/VerifyRaftConfiguration/address-provider steps
+			// elsewhere in this package (all gated on storage.IsRaft) need
+			// to run for this case exactly as they do for "raft".
+			storage.IsRaft = true
+			return storage, cleanup
+		},
+		SupportsHA: true,
+	},
+}
 
-		logger := logger.Named("file")
-		storage, cleanup := teststorage.MakeReusableStorage(
-			t, logger, teststorage.MakeFileBackend(t, logger))
-		defer cleanup()
-		tf(t, logger, storage, 52000)
-	})
+func testVariousBackends(t *testing.T, tf testFunc) {
 
-	t.Run("consul", func(t *testing.T) {
-		t.Parallel()
+	logger := logging.NewVaultLogger(hclog.Debug).Named(t.Name())
 
-		logger := logger.Named("consul")
-		storage, cleanup := teststorage.MakeReusableStorage(
-			t, logger, teststorage.MakeConsulBackend(t, logger))
-		defer cleanup()
-		tf(t, logger, storage, 53000)
-	})
+	for i, backend := range variousBackends {
+		backend := backend
+		basePort := 51000 + i*1000
 
-	t.Run("raft", func(t *testing.T) {
-		t.Parallel()
+		t.Run(backend.Name, func(t *testing.T) {
+			t.Parallel()
 
-		logger := logger.Named("raft")
-		storage, cleanup := teststorage.MakeReusableRaftStorage(t, logger)
-		defer cleanup()
-		tf(t, logger, storage, 54000)
-	})
+			logger := logger.Named(backend.Name)
+			storage, cleanup := backend.NewStorage(t, logger)
+			defer cleanup()
+			tf(t, logger, storage, basePort, backend.SupportsHA)
+		})
+	}
 }
 
-type testFunc func(t *testing.T, logger hclog.Logger, storage teststorage.ReusableStorage, basePort int)
+// testFunc is implemented by each seal-migration scenario in this package.
+// supportsHA reflects the backend's backendFactory.SupportsHA, so scenarios
+// that need real HA semantics (a rolling, one-node-at-a-time migration, for
+// instance) can skip backends that don't provide them instead of
+// exercising a leader/standby dance the backend can't actually perform.
+type testFunc func(t *testing.T, logger hclog.Logger, storage teststorage.ReusableStorage, basePort int, supportsHA bool)
 
 func testShamir(
 	t *testing.T, logger hclog.Logger,
-	storage teststorage.ReusableStorage, basePort int) {
+	storage teststorage.ReusableStorage, basePort int, supportsHA bool) {
 
 	rootToken, keys := initializeShamir(t, logger, storage, basePort)
 	reuseShamir(t, logger, storage, basePort, rootToken, keys)
 }
 
+func testShamirToFakeAutoSeal(
+	t *testing.T, logger hclog.Logger,
+	storage teststorage.ReusableStorage, basePort int, supportsHA bool) {
+
+	rootToken, keys := initializeShamir(t, logger, storage, basePort)
+	migrateFromShamirToAutoSeal(t, logger, storage, basePort, rootToken, keys, newTestFakeSeal(t, logger))
+}
+
+func testFakeAutoSealToShamir(
+	t *testing.T, logger hclog.Logger,
+	storage teststorage.ReusableStorage, basePort int, supportsHA bool) {
+
+	fakeSeal := newTestFakeSeal(t, logger)
+	rootToken, keys := initializeAutoSeal(t, logger, storage, basePort, fakeSeal)
+	migrateFromAutoSealToShamir(t, logger, storage, basePort, rootToken, keys, fakeSeal)
+}
+
+func testShamirToTransit(
+	t *testing.T, logger hclog.Logger,
+	storage teststorage.ReusableStorage, basePort int, supportsHA bool) {
+
+	rootToken, keys := initializeShamir(t, logger, storage, basePort)
+	migrateFromShamirToAutoSeal(t, logger, storage, basePort, rootToken, keys, newTestTransitSeal(t, logger))
+}
+
+func testTransitToShamir(
+	t *testing.T, logger hclog.Logger,
+	storage teststorage.ReusableStorage, basePort int, supportsHA bool) {
+
+	transitSeal := newTestTransitSeal(t, logger)
+	rootToken, keys := initializeAutoSeal(t, logger, storage, basePort, transitSeal)
+	migrateFromAutoSealToShamir(t, logger, storage, basePort, rootToken, keys, transitSeal)
+}
+
+func testTransitToAwsKms(
+	t *testing.T, logger hclog.Logger,
+	storage teststorage.ReusableStorage, basePort int, supportsHA bool) {
+
+	transitSeal := newTestTransitSeal(t, logger)
+	rootToken, keys := initializeAutoSeal(t, logger, storage, basePort, transitSeal)
+	migrateFromAutoSealToAutoSeal(t, logger, storage, basePort, rootToken, keys, transitSeal, newTestAwsKmsSeal(t, logger))
+}
+
+func testAwsKmsToTransit(
+	t *testing.T, logger hclog.Logger,
+	storage teststorage.ReusableStorage, basePort int, supportsHA bool) {
+
+	awsKmsSeal := newTestAwsKmsSeal(t, logger)
+	rootToken, keys := initializeAutoSeal(t, logger, storage, basePort, awsKmsSeal)
+	migrateFromAutoSealToAutoSeal(t, logger, storage, basePort, rootToken, keys, awsKmsSeal, newTestTransitSeal(t, logger))
+}
+
+// initializeAutoSeal initializes a brand new backend storage with the given
+// auto-unseal, mirroring initializeShamir below.
+func initializeAutoSeal(
+	t *testing.T, logger hclog.Logger,
+	storage teststorage.ReusableStorage, basePort int, autoSeal vault.Seal) (string, [][]byte) {
+
+	var baseClusterPort = basePort + 10
+
+	var conf = vault.CoreConfig{
+		Logger: logger.Named("initializeAutoSeal"),
+		Seal:   autoSeal,
+	}
+	var opts = vault.TestClusterOptions{
+		HandlerFunc:           vaulthttp.Handler,
+		BaseListenAddress:     fmt.Sprintf("127.0.0.1:%d", basePort),
+		BaseClusterListenPort: baseClusterPort,
+	}
+	storage.Setup(&conf, &opts)
+	cluster := vault.NewTestCluster(t, &conf, &opts)
+	cluster.Start()
+	defer func() {
+		storage.Cleanup(t, cluster)
+		cluster.Cleanup()
+	}()
+
+	leader := cluster.Cores[0]
+	client := leader.Client
+
+	testhelpers.EnsureCoresUnsealed(t, cluster, client)
+
+	if storage.IsRaft {
+		testhelpers.RaftClusterJoinNodes(t, cluster)
+		if err := testhelpers.VerifyRaftConfiguration(t, leader); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testhelpers.WaitForNCoresUnsealed(t, cluster, vault.DefaultNumCores)
+
+	_, err := client.Logical().Write(
+		"secret/foo",
+		map[string]interface{}{"zork": "quux"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cluster.EnsureCoresSealed(t)
+
+	// Under auto-unseal the barrier key isn't Shamir-split; the recovery
+	// key is what's split instead, and it's what later gets submitted to
+	// trigger migration back to Shamir, so it's what callers need here.
+	return cluster.RootToken, cluster.RecoveryKeys
+}
+
+// migrateFromShamirToAutoSeal restarts a Shamir-sealed cluster with the new
+// auto-unseal as the active seal (and the old Shamir seal kept only as the
+// unwrap seal), unseals with the old Shamir keys to trigger migration, then restarts once more
+// with only the auto-unseal configured to confirm the migration stuck.
+func migrateFromShamirToAutoSeal(
+	t *testing.T, logger hclog.Logger,
+	storage teststorage.ReusableStorage, basePort int,
+	rootToken string, keys [][]byte, newSeal vault.Seal) {
+
+	var baseClusterPort = basePort + 10
+
+	var conf = vault.CoreConfig{
+		Logger: logger.Named("migrateFromShamirToAutoSeal"),
+		Seal:   newSeal,
+	}
+	var opts = vault.TestClusterOptions{
+		HandlerFunc:           vaulthttp.Handler,
+		BaseListenAddress:     fmt.Sprintf("127.0.0.1:%d", basePort),
+		BaseClusterListenPort: baseClusterPort,
+		SkipInit:              true,
+		UnwrapSealFunc: func() vault.Seal {
+			return vault.NewDefaultSeal()
+		},
+	}
+	storage.Setup(&conf, &opts)
+	cluster := vault.NewTestCluster(t, &conf, &opts)
+	cluster.Start()
+	defer func() {
+		storage.Cleanup(t, cluster)
+		cluster.Cleanup()
+	}()
+
+	leader := cluster.Cores[0]
+	client := leader.Client
+	client.SetToken(rootToken)
+
+	cluster.BarrierKeys = keys
+	if storage.IsRaft {
+		provider := testhelpers.NewHardcodedServerAddressProvider(baseClusterPort)
+		testhelpers.SetRaftAddressProviders(t, cluster, provider)
+	}
+
+	// Unseal with the old Shamir keys; this triggers seal migration to the
+	// new auto-unseal.
+	testhelpers.UnsealCoresWithShamirKeys(t, cluster, keys)
+	testhelpers.WaitForNCoresUnsealed(t, cluster, vault.DefaultNumCores)
+
+	if storage.IsRaft {
+		if err := testhelpers.VerifyRaftConfiguration(t, leader); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	secret, err := client.Logical().Read("secret/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(secret.Data, map[string]interface{}{"zork": "quux"}); len(diff) > 0 {
+		t.Fatal(diff)
+	}
+
+	cluster.EnsureCoresSealed(t)
+
+	// Restart once more with only the new auto-unseal configured, to make
+	// sure the migration actually stuck.
+	reuseAutoSeal(t, logger, storage, basePort, rootToken, newSeal)
+}
+
+// migrateFromAutoSealToShamir is the inverse of migrateFromShamirToAutoSeal:
+// it restarts with the old auto-unseal disabled, which causes Vault to fall
+// back to Shamir and ask for unseal keys directly. recoveryKeys are the old
+// auto-sealed cluster's recovery keys (from initializeAutoSeal) — under
+// auto-unseal those, not any barrier keys, are what gets submitted to
+// trigger migration.
+func migrateFromAutoSealToShamir(
+	t *testing.T, logger hclog.Logger,
+	storage teststorage.ReusableStorage, basePort int,
+	rootToken string, recoveryKeys [][]byte, oldSeal vault.Seal) {
+
+	var baseClusterPort = basePort + 10
+
+	var conf = vault.CoreConfig{
+		Logger:     logger.Named("migrateFromAutoSealToShamir"),
+		Seal:       vault.NewDefaultSeal(),
+		UnwrapSeal: oldSeal,
+	}
+	var opts = vault.TestClusterOptions{
+		HandlerFunc:           vaulthttp.Handler,
+		BaseListenAddress:     fmt.Sprintf("127.0.0.1:%d", basePort),
+		BaseClusterListenPort: baseClusterPort,
+		SkipInit:              true,
+	}
+	storage.Setup(&conf, &opts)
+	cluster := vault.NewTestCluster(t, &conf, &opts)
+	cluster.Start()
+	defer func() {
+		storage.Cleanup(t, cluster)
+		cluster.Cleanup()
+	}()
+
+	leader := cluster.Cores[0]
+	client := leader.Client
+	client.SetToken(rootToken)
+
+	cluster.BarrierKeys = recoveryKeys
+	if storage.IsRaft {
+		provider := testhelpers.NewHardcodedServerAddressProvider(baseClusterPort)
+		testhelpers.SetRaftAddressProviders(t, cluster, provider)
+	}
+
+	// Submitting the old recovery keys here is what triggers migration back
+	// to Shamir.
+	testhelpers.UnsealCoresWithShamirKeys(t, cluster, recoveryKeys)
+	testhelpers.WaitForNCoresUnsealed(t, cluster, vault.DefaultNumCores)
+
+	if storage.IsRaft {
+		if err := testhelpers.VerifyRaftConfiguration(t, leader); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	secret, err := client.Logical().Read("secret/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(secret.Data, map[string]interface{}{"zork": "quux"}); len(diff) > 0 {
+		t.Fatal(diff)
+	}
+
+	cluster.EnsureCoresSealed(t)
+
+	reuseShamir(t, logger, storage, basePort, rootToken, recoveryKeys)
+}
+
+// migrateFromAutoSealToAutoSeal restarts a cluster sealed with oldSeal with
+// newSeal active and oldSeal marked disabled, unseals to trigger migration
+// between the two auto-unseal mechanisms, then restarts once more with only
+// newSeal configured to confirm the migration is durable.
+func migrateFromAutoSealToAutoSeal(
+	t *testing.T, logger hclog.Logger,
+	storage teststorage.ReusableStorage, basePort int,
+	rootToken string, recoveryKeys [][]byte, oldSeal, newSeal vault.Seal) {
+
+	var baseClusterPort = basePort + 10
+
+	var conf = vault.CoreConfig{
+		Logger:     logger.Named("migrateFromAutoSealToAutoSeal"),
+		Seal:       newSeal,
+		UnwrapSeal: oldSeal,
+	}
+	var opts = vault.TestClusterOptions{
+		HandlerFunc:           vaulthttp.Handler,
+		BaseListenAddress:     fmt.Sprintf("127.0.0.1:%d", basePort),
+		BaseClusterListenPort: baseClusterPort,
+		SkipInit:              true,
+	}
+	storage.Setup(&conf, &opts)
+	cluster := vault.NewTestCluster(t, &conf, &opts)
+	cluster.Start()
+	defer func() {
+		storage.Cleanup(t, cluster)
+		cluster.Cleanup()
+	}()
+
+	leader := cluster.Cores[0]
+	client := leader.Client
+	client.SetToken(rootToken)
+
+	cluster.BarrierKeys = recoveryKeys
+	if storage.IsRaft {
+		provider := testhelpers.NewHardcodedServerAddressProvider(baseClusterPort)
+		testhelpers.SetRaftAddressProviders(t, cluster, provider)
+	}
+
+	testhelpers.EnsureCoresUnsealed(t, cluster, client)
+	testhelpers.WaitForNCoresUnsealed(t, cluster, vault.DefaultNumCores)
+
+	if storage.IsRaft {
+		if err := testhelpers.VerifyRaftConfiguration(t, leader); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	secret, err := client.Logical().Read("secret/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(secret.Data, map[string]interface{}{"zork": "quux"}); len(diff) > 0 {
+		t.Fatal(diff)
+	}
+
+	cluster.EnsureCoresSealed(t)
+
+	reuseAutoSeal(t, logger, storage, basePort, rootToken, newSeal)
+}
+
+// reuseAutoSeal restarts a cluster sealed with a single, already-migrated
+// auto-unseal and confirms the secret written before the restart is still
+// reachable, mirroring reuseShamir below.
+func reuseAutoSeal(
+	t *testing.T, logger hclog.Logger,
+	storage teststorage.ReusableStorage, basePort int,
+	rootToken string, autoSeal vault.Seal) {
+
+	var baseClusterPort = basePort + 10
+
+	var conf = vault.CoreConfig{
+		Logger: logger.Named("reuseAutoSeal"),
+		Seal:   autoSeal,
+	}
+	var opts = vault.TestClusterOptions{
+		HandlerFunc:           vaulthttp.Handler,
+		BaseListenAddress:     fmt.Sprintf("127.0.0.1:%d", basePort),
+		BaseClusterListenPort: baseClusterPort,
+		SkipInit:              true,
+	}
+	storage.Setup(&conf, &opts)
+	cluster := vault.NewTestCluster(t, &conf, &opts)
+	cluster.Start()
+	defer func() {
+		storage.Cleanup(t, cluster)
+		cluster.Cleanup()
+	}()
+
+	leader := cluster.Cores[0]
+	client := leader.Client
+	client.SetToken(rootToken)
+
+	if storage.IsRaft {
+		provider := testhelpers.NewHardcodedServerAddressProvider(baseClusterPort)
+		testhelpers.SetRaftAddressProviders(t, cluster, provider)
+	}
+
+	testhelpers.EnsureCoresUnsealed(t, cluster, client)
+	testhelpers.WaitForNCoresUnsealed(t, cluster, vault.DefaultNumCores)
+
+	if storage.IsRaft {
+		if err := testhelpers.VerifyRaftConfiguration(t, leader); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	secret, err := client.Logical().Read("secret/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(secret.Data, map[string]interface{}{"zork": "quux"}); len(diff) > 0 {
+		t.Fatal(diff)
+	}
+
+	cluster.EnsureCoresSealed(t)
+}
+
 // initializeShamir initializes a brand new backend storage with Shamir.
 func initializeShamir(
 	t *testing.T, logger hclog.Logger,
@@ -168,8 +623,9 @@ func reuseShamir(
 		for _, core := range cluster.Cores {
 			cluster.UnsealCore(t, core)
 		}
-		// It saddens me that this is necessary
-		time.Sleep(15 * time.Second)
+		// Rather than sleeping for a fixed amount of time, wait for
+		// autopilot to actually report every voter as healthy.
+		waitForAutopilotHealthy(t, client)
 		if err := testhelpers.VerifyRaftConfiguration(t, leader); err != nil {
 			t.Fatal(err)
 		}
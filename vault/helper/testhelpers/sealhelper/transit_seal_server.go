@@ -0,0 +1,83 @@
+package sealhelper
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-kms-wrapping/wrappers/transit"
+	"github.com/hashicorp/vault/api"
+	vaulthttp "github.com/hashicorp/vault/http"
+	"github.com/hashicorp/vault/vault"
+	"github.com/hashicorp/vault/vault/seal"
+)
+
+// TransitSealServer is a single-node, in-memory Vault cluster with the
+// transit secrets engine mounted, used to mint real Transit-backed seals for
+// tests that need genuine Transit auto-unseal behavior without depending on
+// an externally-reachable Vault server.
+type TransitSealServer struct {
+	cluster *vault.TestCluster
+}
+
+// NewTransitSealServer brings up a TransitSealServer with the transit
+// secrets engine mounted, and registers its teardown with t.Cleanup.
+func NewTransitSealServer(t *testing.T) *TransitSealServer {
+	t.Helper()
+
+	conf := &vault.CoreConfig{
+		Logger: hclog.NewNullLogger(),
+	}
+	opts := &vault.TestClusterOptions{
+		NumCores:    1,
+		HandlerFunc: vaulthttp.Handler,
+	}
+	cluster := vault.NewTestCluster(t, conf, opts)
+	cluster.Start()
+	t.Cleanup(cluster.Cleanup)
+
+	vault.TestWaitActive(t, cluster.Cores[0].Core)
+
+	if err := cluster.Cores[0].Client.Sys().Mount("transit", &api.MountInput{
+		Type: "transit",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	return &TransitSealServer{cluster: cluster}
+}
+
+// MakeKey creates a new transit key named name on the server, for MakeSeal
+// to later wrap.
+func (ts *TransitSealServer) MakeKey(t *testing.T, name string) {
+	t.Helper()
+
+	if _, err := ts.client().Logical().Write(fmt.Sprintf("transit/keys/%s", name), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// MakeSeal returns a Transit-backed vault.Seal wrapping the key name, which
+// must already have been created with MakeKey.
+func (ts *TransitSealServer) MakeSeal(t *testing.T, name string) vault.Seal {
+	t.Helper()
+
+	client := ts.client()
+	wrapper := transit.NewWrapper(nil)
+	if _, err := wrapper.SetConfig(map[string]string{
+		"address":    client.Address(),
+		"token":      client.Token(),
+		"mount_path": "transit/",
+		"key_name":   name,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	return vault.NewAutoSeal(&seal.Access{
+		Wrapper: wrapper,
+	})
+}
+
+func (ts *TransitSealServer) client() *api.Client {
+	return ts.cluster.Cores[0].Client
+}
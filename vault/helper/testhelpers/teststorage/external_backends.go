@@ -0,0 +1,67 @@
+package teststorage
+
+import (
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/physical/mysql"
+	"github.com/hashicorp/vault/physical/postgresql"
+	"github.com/hashicorp/vault/physical/s3"
+	"github.com/hashicorp/vault/vault"
+)
+
+// MakePostgreSQLBackend builds a PhysicalBackendBundle backed by a real
+// PostgreSQL server reachable at dsn. Like MakeConsulBackend, it provides no
+// HABackend of its own, so callers wanting HA coverage against it pair it
+// with MakeReusableRaftHAStorage instead of MakeReusableStorage.
+func MakePostgreSQLBackend(t *testing.T, logger hclog.Logger, dsn string) *vault.PhysicalBackendBundle {
+	t.Helper()
+
+	be, err := postgresql.NewPostgreSQLBackend(map[string]string{
+		"connection_url": dsn,
+	}, logger.Named("storage.postgresql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &vault.PhysicalBackendBundle{
+		Backend: be,
+	}
+}
+
+// MakeMySQLBackend builds a PhysicalBackendBundle backed by a real MySQL
+// server reachable at dsn. As with MakePostgreSQLBackend, it has no
+// HABackend of its own.
+func MakeMySQLBackend(t *testing.T, logger hclog.Logger, dsn string) *vault.PhysicalBackendBundle {
+	t.Helper()
+
+	be, err := mysql.NewMySQLBackend(map[string]string{
+		"connection_url": dsn,
+	}, logger.Named("storage.mysql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &vault.PhysicalBackendBundle{
+		Backend: be,
+	}
+}
+
+// MakeS3Backend builds a PhysicalBackendBundle backed by a real S3 bucket.
+// Credentials and region are picked up from the standard AWS environment
+// variables, same as MakeS3Backend's callers use skipUnlessEnv to gate on
+// the bucket name itself. It has no HABackend of its own.
+func MakeS3Backend(t *testing.T, logger hclog.Logger, bucket string) *vault.PhysicalBackendBundle {
+	t.Helper()
+
+	be, err := s3.NewS3Backend(map[string]string{
+		"bucket": bucket,
+	}, logger.Named("storage.s3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &vault.PhysicalBackendBundle{
+		Backend: be,
+	}
+}